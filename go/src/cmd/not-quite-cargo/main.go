@@ -2,14 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -36,12 +44,27 @@ type Invocation struct {
 	Args         []string        `json:"args"`
 	Env          map[string]string `json:"env"`
 	Cwd          string          `json:"cwd"`
+	// LinksName is the package's manifest `links = "foo"` value, if any.
+	// The build plan schema itself has no such field; generate fills this
+	// in by cross-referencing `cargo metadata`. Not to be confused with
+	// Links above, which is an unrelated symlink table.
+	LinksName string `json:"links_name"`
 }
 
 // CustomBuildDirectives captures directives from build script output.
 type CustomBuildDirectives struct {
-	RustcFlags []string
-	EnvVars    map[string]string
+	RustcFlags []string          `json:"rustc_flags"`
+	EnvVars    map[string]string `json:"env_vars"`
+	// Metadata holds every other-wise unrecognized `cargo:KEY=VALUE` line,
+	// keyed by KEY. For a package that declares `links`, these are the
+	// values forwarded to dependents as DEP_<LINKS>_<KEY> env vars.
+	Metadata map[string]string `json:"metadata"`
+	// LinkedLibs, LinkedPaths, and Cfgs mirror the rustc-link-lib,
+	// rustc-link-search, and rustc-cfg directives in their raw, unflagged
+	// form, for reporting in build-script-executed JSON messages.
+	LinkedLibs  []string `json:"linked_libs"`
+	LinkedPaths []string `json:"linked_paths"`
+	Cfgs        []string `json:"cfgs"`
 }
 
 // NewCustomBuildDirectives parses the output of a build script.
@@ -51,15 +74,21 @@ func NewCustomBuildDirectives(output string) *CustomBuildDirectives {
 	directives := &CustomBuildDirectives{
 		RustcFlags: []string{},
 		EnvVars:    make(map[string]string),
+		Metadata:   make(map[string]string),
 	}
 
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
-		if !strings.HasPrefix(line, "cargo:") {
+		var rest string
+		switch {
+		case strings.HasPrefix(line, "cargo::"):
+			rest = strings.TrimPrefix(line, "cargo::")
+		case strings.HasPrefix(line, "cargo:"):
+			rest = strings.TrimPrefix(line, "cargo:")
+		default:
 			continue
 		}
-		line = strings.TrimPrefix(line, "cargo:")
-		parts := strings.SplitN(line, "=", 2)
+		parts := strings.SplitN(rest, "=", 2)
 		if len(parts) != 2 {
 			log.Printf("Warning: Malformed build script output line (no '='): %s", line)
 			continue
@@ -71,12 +100,16 @@ func NewCustomBuildDirectives(output string) *CustomBuildDirectives {
 		}
 
 		switch key {
+		case "warning":
+			log.Printf("cargo:warning: %s", value)
 		case "rustc-cfg":
 			directives.RustcFlags = append(directives.RustcFlags, "--cfg", value)
+			directives.Cfgs = append(directives.Cfgs, value)
 		case "rustc-check-cfg":
 			directives.RustcFlags = append(directives.RustcFlags, "--check-cfg", value)
 		case "rustc-link-lib":
 			directives.RustcFlags = append(directives.RustcFlags, "-l", value)
+			directives.LinkedLibs = append(directives.LinkedLibs, value)
 		case "rustc-link-arg":
 			directives.RustcFlags = append(directives.RustcFlags, "-C", "link-arg="+value)
 		case "rustc-link-search":
@@ -85,21 +118,41 @@ func NewCustomBuildDirectives(output string) *CustomBuildDirectives {
 				// kind := pathParts[0]
 				path := pathParts[1]
 				directives.RustcFlags = append(directives.RustcFlags, "-L", path)
+				directives.LinkedPaths = append(directives.LinkedPaths, path)
 			} else {
 				directives.RustcFlags = append(directives.RustcFlags, "-L", value)
+				directives.LinkedPaths = append(directives.LinkedPaths, value)
 			}
 		case "rustc-env":
 			kv := strings.SplitN(value, "=", 2)
 			if len(kv) == 2 {
 				directives.EnvVars[kv[0]] = kv[1]
 			}
+		case "metadata":
+			// The cargo:: protocol nests arbitrary KEY=VALUE metadata one
+			// level deeper than cargo: did: `cargo::metadata=KEY=VALUE`,
+			// not a bare `cargo::KEY=VALUE`.
+			kv := strings.SplitN(value, "=", 2)
+			if len(kv) != 2 {
+				log.Printf("Warning: Malformed cargo::metadata directive (expected KEY=VALUE): %s", value)
+				continue
+			}
+			directives.Metadata[kv[0]] = kv[1]
 		default:
-			log.Printf("Warning: Unknown build script output line: %s", line)
+			directives.Metadata[key] = value
 		}
 	}
 	return directives
 }
 
+// packageLinksName returns the native library name a package links
+// against, i.e. its manifest's `links = "foo"` value, or "" if it declares
+// no `links`. The build plan format has no field for this itself; generate
+// fills in Invocation.LinksName by cross-referencing `cargo metadata`.
+func packageLinksName(inv Invocation) string {
+	return inv.LinksName
+}
+
 // apply modifies the command and environment based on the directives.
 func (d *CustomBuildDirectives) Apply(cmd *exec.Cmd) {
 	cmd.Args = append(cmd.Args, d.RustcFlags...)
@@ -108,6 +161,216 @@ func (d *CustomBuildDirectives) Apply(cmd *exec.Cmd) {
 	}
 }
 
+// buildDirectivesCache holds the parsed build-script directives keyed by
+// invocation number (rather than package name, since a package can have
+// more than one unit and each needs its own metadata preserved), guarded by
+// a mutex since run-custom-build units complete concurrently with the
+// units that depend on them.
+type buildDirectivesCache struct {
+	mu sync.Mutex
+	m  map[int]*CustomBuildDirectives
+}
+
+func newBuildDirectivesCache() *buildDirectivesCache {
+	return &buildDirectivesCache{m: make(map[int]*CustomBuildDirectives)}
+}
+
+func (c *buildDirectivesCache) get(invocationNumber int) (*CustomBuildDirectives, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.m[invocationNumber]
+	return d, ok
+}
+
+func (c *buildDirectivesCache) set(invocationNumber int, d *CustomBuildDirectives) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[invocationNumber] = d
+}
+
+// taggedLogWriter streams a subprocess's output line by line, tagging each
+// line with the invocation it came from so interleaved parallel output
+// stays attributable to a specific unit.
+type taggedLogWriter struct {
+	prefix string
+	buf    []byte
+}
+
+func newTaggedLogWriter(prefix string) *taggedLogWriter {
+	return &taggedLogWriter{prefix: prefix}
+}
+
+func (w *taggedLogWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		log.Printf("%s %s", w.prefix, string(w.buf[:idx]))
+		w.buf = w.buf[idx+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs any trailing partial line left in the buffer.
+func (w *taggedLogWriter) Flush() {
+	if len(w.buf) > 0 {
+		log.Printf("%s %s", w.prefix, string(w.buf))
+		w.buf = nil
+	}
+}
+
+// jsonTarget is the `target` field of a compiler-artifact message.
+type jsonTarget struct {
+	Kind []string `json:"kind"`
+	Name string   `json:"name"`
+}
+
+// compilerArtifactMsg mirrors (a useful subset of) Cargo's
+// `--message-format=json` compiler-artifact record.
+type compilerArtifactMsg struct {
+	Reason    string     `json:"reason"`
+	PackageID string     `json:"package_id"`
+	Target    jsonTarget `json:"target"`
+	Filenames []string   `json:"filenames"`
+	Fresh     bool       `json:"fresh"`
+}
+
+// compilerMessageMsg wraps a single rustc `--error-format=json` diagnostic
+// as Cargo's compiler-message record.
+type compilerMessageMsg struct {
+	Reason    string          `json:"reason"`
+	PackageID string          `json:"package_id"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// buildScriptExecutedMsg mirrors Cargo's build-script-executed record.
+type buildScriptExecutedMsg struct {
+	Reason      string            `json:"reason"`
+	PackageID   string            `json:"package_id"`
+	LinkedLibs  []string          `json:"linked_libs"`
+	LinkedPaths []string          `json:"linked_paths"`
+	Cfgs        []string          `json:"cfgs"`
+	Env         map[string]string `json:"env"`
+	OutDir      string            `json:"out_dir"`
+}
+
+// buildFinishedMsg mirrors Cargo's final build-finished record.
+type buildFinishedMsg struct {
+	Reason  string `json:"reason"`
+	Success bool   `json:"success"`
+}
+
+// packageID approximates Cargo's package_id for an invocation. Cargo's real
+// package_id also encodes the source (registry/path/git); the build plan
+// doesn't carry that, so "name version" is the best we can reconstruct.
+func packageID(inv Invocation) string {
+	return fmt.Sprintf("%s %s", inv.PackageName, inv.PackageVersion)
+}
+
+// emitMessageMu serializes stdout writes across the goroutines runInvocation
+// is called from concurrently (chunk0-1's worker pool). A compiler-message
+// line embeds rustc's full rendered diagnostic and can easily exceed
+// PIPE_BUF, so without this two invocations finishing at once could
+// interleave partial lines and break the one-JSON-object-per-line contract.
+var emitMessageMu sync.Mutex
+
+// emitMessage writes a single JSON message line to stdout, matching
+// `cargo --message-format=json`'s one-object-per-line output.
+func emitMessage(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Warning: failed to marshal JSON message: %v", err)
+		return
+	}
+	emitMessageMu.Lock()
+	defer emitMessageMu.Unlock()
+	fmt.Println(string(data))
+}
+
+// jsonMessageWriter demultiplexes a rustc `--error-format=json` stderr
+// stream line by line, re-emitting each diagnostic as a compiler-message.
+// Non-JSON lines (e.g. a linker error) are passed through to stderr as-is.
+type jsonMessageWriter struct {
+	packageID         string
+	renderDiagnostics bool
+	buf               []byte
+}
+
+func newJSONMessageWriter(packageID string, renderDiagnostics bool) *jsonMessageWriter {
+	return &jsonMessageWriter{packageID: packageID, renderDiagnostics: renderDiagnostics}
+}
+
+func (w *jsonMessageWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		w.handleLine(w.buf[:idx])
+		w.buf = w.buf[idx+1:]
+	}
+	return len(p), nil
+}
+
+// Flush handles any trailing partial line left in the buffer.
+func (w *jsonMessageWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.handleLine(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *jsonMessageWriter) handleLine(line []byte) {
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) == 0 {
+		return
+	}
+	if !json.Valid(trimmed) {
+		fmt.Fprintln(os.Stderr, string(line))
+		return
+	}
+	emitMessage(compilerMessageMsg{Reason: "compiler-message", PackageID: w.packageID, Message: json.RawMessage(append([]byte(nil), trimmed...))})
+	if w.renderDiagnostics {
+		var rendered struct {
+			Rendered string `json:"rendered"`
+		}
+		if err := json.Unmarshal(trimmed, &rendered); err == nil && rendered.Rendered != "" {
+			fmt.Fprint(os.Stderr, rendered.Rendered)
+		}
+	}
+}
+
+// emitFreshMessage emits the JSON message for an invocation that the
+// fingerprint cache determined didn't need to be re-run.
+func emitFreshMessage(inv Invocation, cached *Fingerprint) {
+	if inv.CompileMode == "run-custom-build" {
+		d := cached.Directives
+		if d == nil {
+			d = &CustomBuildDirectives{EnvVars: map[string]string{}}
+		}
+		emitMessage(buildScriptExecutedMsg{
+			Reason:      "build-script-executed",
+			PackageID:   packageID(inv),
+			LinkedLibs:  d.LinkedLibs,
+			LinkedPaths: d.LinkedPaths,
+			Cfgs:        d.Cfgs,
+			Env:         d.EnvVars,
+			OutDir:      inv.Env["OUT_DIR"],
+		})
+		return
+	}
+	emitMessage(compilerArtifactMsg{
+		Reason:    "compiler-artifact",
+		PackageID: packageID(inv),
+		Target:    jsonTarget{Kind: inv.TargetKind, Name: inv.PackageName},
+		Filenames: cached.Outputs,
+		Fresh:     true,
+	})
+}
+
 // deepReplace recursively replaces strings in a map, slice, or string.
 func deepReplace(data interface{}, replacements map[string]string) interface{} {
 	switch v := data.(type) {
@@ -169,6 +432,195 @@ func resolveInvocationOrder(invocations []Invocation) []Invocation {
 	return ordered
 }
 
+// newInvocation builds an Invocation programmatically rather than by
+// unmarshalling one out of a build plan file. It's used by the sysroot
+// subcommand, which has no build plan to read from and instead synthesizes
+// one in memory to hand to executeInvocations.
+func newInvocation(number int, packageName, compileMode, program string, args []string, deps []int, outputs []string) Invocation {
+	return Invocation{
+		Number:      number,
+		PackageName: packageName,
+		CompileMode: compileMode,
+		Deps:        deps,
+		Outputs:     outputs,
+		Links:       map[string]string{},
+		Program:     program,
+		Args:        args,
+		Env:         map[string]string{},
+	}
+}
+
+// targetDir returns the Cargo target directory, honoring CARGO_TARGET_DIR.
+func targetDir() string {
+	if td := os.Getenv("CARGO_TARGET_DIR"); td != "" {
+		return td
+	}
+	return "target"
+}
+
+// fingerprintDir returns the directory where per-invocation fingerprint
+// JSON files are persisted.
+func fingerprintDir() string {
+	return filepath.Join(targetDir(), ".not-quite-cargo", "fingerprints")
+}
+
+// Fingerprint records enough about a previously-run invocation to decide,
+// on a later run, whether it can be skipped: mirrors Cargo's Freshness.
+type Fingerprint struct {
+	InputHash  string                 `json:"input_hash"`
+	InputFiles []string               `json:"input_files"`
+	Outputs    []string               `json:"outputs"`
+	Directives *CustomBuildDirectives `json:"directives,omitempty"`
+}
+
+// fingerprintPath returns the path of the fingerprint file for an
+// invocation, keyed by its package name and version, target kinds, kind,
+// compile mode, and working directory rather than the build-plan invocation
+// number, which isn't stable across plan regeneration.
+func fingerprintPath(dir string, inv Invocation) string {
+	kind := ""
+	if inv.Kind != nil {
+		kind = *inv.Kind
+	}
+	id := strings.Join([]string{inv.PackageName, inv.PackageVersion, strings.Join(inv.TargetKind, ","), kind, inv.CompileMode, inv.Cwd}, "|")
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// loadFingerprint reads a fingerprint file, returning nil if it doesn't
+// exist or can't be parsed.
+func loadFingerprint(path string) *Fingerprint {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var fp Fingerprint
+	if err := json.Unmarshal(data, &fp); err != nil {
+		return nil
+	}
+	return &fp
+}
+
+// saveFingerprint persists a fingerprint file, creating its directory if
+// necessary.
+func saveFingerprint(path string, fp *Fingerprint) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(fp, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// hashInvocationInputs computes a stable hash over an invocation's program,
+// sorted args, sorted env, working directory, and the mtime+size of every
+// input file.
+func hashInvocationInputs(inv Invocation, inputFiles []string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "program=%s\n", inv.Program)
+
+	args := append([]string(nil), inv.Args...)
+	sort.Strings(args)
+	fmt.Fprintf(h, "args=%s\n", strings.Join(args, "\x1f"))
+
+	envKeys := make([]string, 0, len(inv.Env))
+	for k := range inv.Env {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+	for _, k := range envKeys {
+		fmt.Fprintf(h, "env=%s=%s\n", k, inv.Env[k])
+	}
+
+	fmt.Fprintf(h, "cwd=%s\n", inv.Cwd)
+
+	files := append([]string(nil), inputFiles...)
+	sort.Strings(files)
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			fmt.Fprintf(h, "input=%s=missing\n", f)
+			continue
+		}
+		fmt.Fprintf(h, "input=%s=%d=%d\n", f, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checkFingerprint returns the cached fingerprint for inv if its recorded
+// outputs still exist and its input hash still matches, or nil if the
+// invocation needs to be re-run.
+func checkFingerprint(path string, inv Invocation, globalInputs []string) *Fingerprint {
+	fp := loadFingerprint(path)
+	if fp == nil {
+		return nil
+	}
+	for _, out := range fp.Outputs {
+		if _, err := os.Stat(out); err != nil {
+			return nil
+		}
+	}
+	inputFiles := append(append([]string(nil), globalInputs...), fp.InputFiles...)
+	if hashInvocationInputs(inv, inputFiles) != fp.InputHash {
+		return nil
+	}
+	return fp
+}
+
+// depInfoFilesFor returns the `.d` dep-info file paths rustc writes
+// alongside an invocation's declared outputs. A library output is named
+// lib<crate>..., while its dep-info file drops the "lib" prefix, so both
+// names are returned for an output whose name starts with "lib".
+func depInfoFilesFor(outputs []string) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, out := range outputs {
+		stem := strings.TrimSuffix(filepath.Base(out), filepath.Ext(out))
+		stems := []string{stem}
+		if trimmed := strings.TrimPrefix(stem, "lib"); trimmed != stem && trimmed != "" {
+			stems = append(stems, trimmed)
+		}
+		for _, s := range stems {
+			depPath := filepath.Join(filepath.Dir(out), s+".d")
+			if !seen[depPath] {
+				seen[depPath] = true
+				paths = append(paths, depPath)
+			}
+		}
+	}
+	return paths
+}
+
+// parseDepInfoFile parses a Makefile-style `.d` dep-info file as emitted by
+// rustc, returning the list of files it depends on. Missing or unreadable
+// files yield no dependencies rather than an error, since not every
+// invocation emits one.
+func parseDepInfoFile(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	content := strings.ReplaceAll(string(data), "\\\n", " ")
+	colon := strings.Index(content, ":")
+	if colon < 0 {
+		return nil
+	}
+	// Only the first rule lists dependencies; later lines are further
+	// targets and empty phony rules.
+	rule := content[colon+1:]
+	if nl := strings.IndexByte(rule, '\n'); nl >= 0 {
+		rule = rule[:nl]
+	}
+	var deps []string
+	for _, field := range strings.Fields(rule) {
+		deps = append(deps, strings.ReplaceAll(field, "\\ ", " "))
+	}
+	return deps
+}
+
 // findRustc tries to locate the rustc executable.
 func findRustc() (string, error) {
 	if path, ok := syscall.Getenv("RUSTC"); ok && path != "" {
@@ -197,6 +649,173 @@ func findRustc() (string, error) {
 	return "rustc", nil // Fallback
 }
 
+// findCargo tries to locate the cargo executable.
+func findCargo() (string, error) {
+	if path, ok := syscall.Getenv("CARGO"); ok && path != "" {
+		log.Printf("Found cargo at %s using CARGO environment variable.", path)
+		return path, nil
+	}
+
+	if rustup, err := exec.LookPath("rustup"); err == nil {
+		log.Printf("Using rustup at %s to find cargo.", rustup)
+		cmd := exec.Command(rustup, "which", "cargo")
+		cmd.Dir = "/"
+		cmd.Env = os.Environ()
+		if output, err := cmd.CombinedOutput(); err == nil {
+			path := strings.TrimSpace(string(output))
+			log.Printf("Found cargo at %s using rustup.", path)
+			return path, nil
+		}
+	}
+
+	// Fallback to PATH if rustup is not available
+	if path, err := exec.LookPath("cargo"); err == nil {
+		log.Printf("Found cargo at %s using PATH.", path)
+		return path, nil
+	}
+	log.Printf("Warning: Could not find cargo using CARGO or rustup. Falling back to 'cargo' in PATH.")
+	return "cargo", nil // Fallback
+}
+
+// generate mode drives `cargo build --build-plan` to produce a build plan
+// file, then runs it through the existing patch pass so the result is
+// committed-ready.
+func generate(outputPath string, targetDir string, release bool, target string, features string, extraArgs []string, replacements map[string]string) {
+	cargoPath, _ := findCargo()
+
+	buildArgs := func(nightly bool) []string {
+		var args []string
+		if nightly {
+			args = append(args, "+nightly")
+		}
+		args = append(args, "build", "--build-plan", "-Z", "unstable-options")
+		if release {
+			args = append(args, "--release")
+		}
+		if targetDir != "" {
+			args = append(args, "--target-dir", targetDir)
+		}
+		if target != "" {
+			args = append(args, "--target", target)
+		}
+		if features != "" {
+			args = append(args, "--features", features)
+		}
+		args = append(args, extraArgs...)
+		return args
+	}
+
+	runCargoBuildPlan := func(nightly bool) ([]byte, error) {
+		args := buildArgs(nightly)
+		log.Printf("Running: %s %s", cargoPath, strings.Join(args, " "))
+		cmd := exec.Command(cargoPath, args...)
+		cmd.Env = os.Environ()
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("%v\n%s", err, stderr.String())
+		}
+		return stdout.Bytes(), nil
+	}
+
+	data, err := runCargoBuildPlan(false)
+	if err != nil {
+		log.Printf("cargo rejected --build-plan on the default toolchain (%v); retrying with +nightly", err)
+		data, err = runCargoBuildPlan(true)
+		if err != nil {
+			log.Fatalf("Failed to generate build plan, even with +nightly: %v\n"+
+				"Install a nightly toolchain with 'rustup toolchain install nightly' and retry.", err)
+		}
+	}
+
+	if linksNames, err := packageLinksNames(cargoPath); err != nil {
+		log.Printf("Warning: failed to query cargo metadata for `links` names: %v", err)
+	} else if len(linksNames) > 0 {
+		annotated, err := annotateLinksNames(data, linksNames)
+		if err != nil {
+			log.Printf("Warning: failed to annotate build plan with `links` names: %v", err)
+		} else {
+			data = annotated
+		}
+	}
+
+	if err := os.WriteFile(outputPath, data, 0644); err != nil {
+		log.Fatalf("Failed to write build plan to %s: %v", outputPath, err)
+	}
+	log.Printf("Wrote build plan to %s", outputPath)
+
+	patch(outputPath, replacements)
+}
+
+// packageLinksNames queries `cargo metadata` for every package's manifest
+// `links` declaration, keyed by "name version" to match Invocation's
+// PackageName/PackageVersion. The build plan itself never carries this
+// string, so generate has to get it from metadata instead.
+func packageLinksNames(cargoPath string) (map[string]string, error) {
+	out, err := exec.Command(cargoPath, "metadata", "--format-version=1").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var meta struct {
+		Packages []struct {
+			Name    string  `json:"name"`
+			Version string  `json:"version"`
+			Links   *string `json:"links"`
+		} `json:"packages"`
+	}
+	if err := json.Unmarshal(out, &meta); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	for _, pkg := range meta.Packages {
+		if pkg.Links != nil && *pkg.Links != "" {
+			names[pkg.Name+" "+pkg.Version] = *pkg.Links
+		}
+	}
+	return names, nil
+}
+
+// annotateLinksNames stamps each build plan invocation whose package
+// declares `links` with Invocation.LinksName, so run can forward DEP_*
+// metadata without having to re-query cargo metadata itself.
+func annotateLinksNames(data []byte, linksNames map[string]string) ([]byte, error) {
+	var buildPlan map[string]interface{}
+	if err := json.Unmarshal(data, &buildPlan); err != nil {
+		return nil, err
+	}
+
+	invocations, ok := buildPlan["invocations"].([]interface{})
+	if !ok {
+		return data, nil
+	}
+	for _, invRaw := range invocations {
+		if inv, ok := invRaw.(map[string]interface{}); ok {
+			backfillLinksName(inv, linksNames)
+		}
+	}
+
+	return json.Marshal(buildPlan)
+}
+
+// backfillLinksName sets inv["links_name"] from linksNames (keyed by "name
+// version", as returned by packageLinksNames) if inv doesn't already carry
+// one. Used by both generate's annotateLinksNames and patch, so that
+// DEP_<LINKS>_<KEY> forwarding also works for a build plan obtained the
+// "out of band" way (not through generate) and fed straight to patch.
+func backfillLinksName(inv map[string]interface{}, linksNames map[string]string) {
+	if ln, ok := inv["links_name"].(string); ok && ln != "" {
+		return
+	}
+	name, _ := inv["package_name"].(string)
+	version, _ := inv["package_version"].(string)
+	if linksName, ok := linksNames[name+" "+version]; ok {
+		inv["links_name"] = linksName
+	}
+}
+
 // patch mode modifies the build plan JSON file in place.
 func patch(buildPlanPath string, replacements map[string]string) {
 	log.Printf("Patching build plan file: %s", buildPlanPath)
@@ -225,6 +844,19 @@ func patch(buildPlanPath string, replacements map[string]string) {
 		log.Fatalf("%s does not look like a Cargo build plan file.", buildPlanPath)
 	}
 
+	// Back-fill links_name for any invocation that doesn't already carry
+	// one, so DEP_<LINKS>_<KEY> forwarding (chunk0-3) also works for a plan
+	// obtained some other way and fed straight to patch, not just one that
+	// went through generate's own annotateLinksNames.
+	var linksNames map[string]string
+	if cargoPath, err := findCargo(); err != nil {
+		log.Printf("Warning: failed to find cargo to backfill `links` names: %v", err)
+	} else if names, err := packageLinksNames(cargoPath); err != nil {
+		log.Printf("Warning: failed to query cargo metadata to backfill `links` names: %v", err)
+	} else {
+		linksNames = names
+	}
+
 	patchedInvocations := make([]map[string]interface{}, len(invocations))
 	for i, invRaw := range invocations {
 		inv, ok := invRaw.(map[string]interface{})
@@ -232,6 +864,10 @@ func patch(buildPlanPath string, replacements map[string]string) {
 			log.Fatalf("Invalid invocation format.")
 		}
 
+		if linksNames != nil {
+			backfillLinksName(inv, linksNames)
+		}
+
 		// Patching `program`
 		if program, ok := inv["program"].(string); ok && program == "rustc" {
 			inv["program"] = rustcPlaceholder
@@ -292,15 +928,10 @@ func patch(buildPlanPath string, replacements map[string]string) {
 	log.Printf("Patched build plan saved to %s", buildPlanPath)
 }
 
-// run mode executes the commands from the build plan.
-func run(buildPlanPath string, replacements map[string]string) {
-	cmd := exec.Command(rustcPath, "-vV")
-	if out, err := cmd.CombinedOutput(); err != nil {
-		log.Fatalf("Failed getting rustc version from %s: %v\nOutput:\n%s", rustcPath, err, string(out))
-	} else {
-		log.Printf("{{RUSTC}} version: %s", strings.Split(string(out), "\n")[0])
-	}
-
+// loadInvocations reads a build plan file, applies the placeholder
+// replacements, and returns its invocations (ordered and numbered) along
+// with the build plan's top-level `inputs` array, if any.
+func loadInvocations(buildPlanPath string, replacements map[string]string) ([]Invocation, []string) {
 	data, err := os.ReadFile(buildPlanPath)
 	if err != nil {
 		log.Fatalf("Failed to read build plan file: %v", err)
@@ -322,10 +953,10 @@ func run(buildPlanPath string, replacements map[string]string) {
 		if err := json.Unmarshal(invRaw, &inv); err != nil {
 			log.Fatalf("Failed to unmarshal invocation: %v", err)
 		}
-		
+
 		replacedInv := deepReplace(inv, replacements).(map[string]interface{})
 		replacedJSON, _ := json.Marshal(replacedInv)
-		
+
 		var finalInv Invocation
 		if err := json.Unmarshal(replacedJSON, &finalInv); err != nil {
 			log.Fatalf("Failed to re-unmarshal invocation after replacement: %v", err)
@@ -340,6 +971,133 @@ func run(buildPlanPath string, replacements map[string]string) {
 
 	invocations = resolveInvocationOrder(invocations)
 
+	var globalInputs []string
+	if rawInputs, ok := buildPlan["inputs"]; ok {
+		var inputs []interface{}
+		if err := json.Unmarshal(rawInputs, &inputs); err == nil {
+			replaced := deepReplace(inputs, replacements).([]interface{})
+			for _, item := range replaced {
+				if s, ok := item.(string); ok {
+					globalInputs = append(globalInputs, s)
+				}
+			}
+		}
+	}
+
+	return invocations, globalInputs
+}
+
+// run mode executes the commands from the build plan.
+func run(buildPlanPath string, replacements map[string]string, jobs int, force bool, messageFormat string, target string) {
+	cmd := exec.Command(rustcPath, "-vV")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Fatalf("Failed getting rustc version from %s: %v\nOutput:\n%s", rustcPath, err, string(out))
+	} else {
+		log.Printf("{{RUSTC}} version: %s", strings.Split(string(out), "\n")[0])
+	}
+
+	invocations, globalInputs := loadInvocations(buildPlanPath, replacements)
+
+	if target != "" {
+		retargetInvocations(invocations, target)
+	}
+
+	if err := executeInvocations(invocations, globalInputs, jobs, force, messageFormat); err != nil {
+		log.Fatalf("Build failed: %v", err)
+	}
+
+	log.Println("Build plan execution complete.")
+}
+
+// retargetInvocations rewrites every host-independent invocation's --target
+// argument to target (a triple, or an absolute path to a custom target spec
+// resolved by resolveTargetSpec), and, if a sysroot built by the sysroot
+// subcommand exists for it, appends --sysroot pointing at it. Units that
+// must run on (or be loadable by) the host rather than the target --
+// build-script execution, build-script *compilation*, and proc-macro crates
+// -- are left alone. CompileMode == "run-custom-build" only catches the
+// first of those; Kind (Cargo's own host-vs-target discriminator, "host" or
+// null) is what's needed for the other two.
+func retargetInvocations(invocations []Invocation, target string) {
+	targetArg, targetDirName := resolveTargetSpec(target)
+
+	sysrootDir := filepath.Join(targetDir(), targetDirName, "sysroot")
+	hasSysroot := false
+	if info, err := os.Stat(sysrootDir); err == nil && info.IsDir() {
+		hasSysroot = true
+		log.Printf("Using sysroot for %s at %s", targetArg, sysrootDir)
+	}
+
+	for i := range invocations {
+		if invocations[i].CompileMode == "run-custom-build" {
+			continue
+		}
+		if invocations[i].Kind != nil && *invocations[i].Kind == "host" {
+			continue
+		}
+		invocations[i].Args = rewriteTargetArgs(invocations[i].Args, targetArg)
+		if hasSysroot {
+			invocations[i].Args = append(invocations[i].Args, "--sysroot", sysrootDir)
+		}
+	}
+}
+
+// resolveTargetSpec turns a --target value into the argument to pass to
+// rustc and the name used to key its target-specific directories under
+// target/. For a plain triple (e.g. "x86_64-unknown-linux-gnu") the two are
+// the same string; for a custom JSON target spec, the path is resolved to
+// an absolute one (rustc requires this) and the directory name is the
+// spec's file stem, matching how Cargo itself names target/<name>.
+func resolveTargetSpec(target string) (arg string, dirName string) {
+	if !strings.HasSuffix(target, ".json") {
+		return target, target
+	}
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		log.Fatalf("Failed to resolve target spec path %s: %v", target, err)
+	}
+	return abs, strings.TrimSuffix(filepath.Base(target), ".json")
+}
+
+// rewriteTargetArgs replaces the value of an existing --target or
+// --target=VALUE argument with targetArg, or appends one if the invocation
+// didn't have one (e.g. it was built for the host).
+func rewriteTargetArgs(args []string, targetArg string) []string {
+	result := make([]string, 0, len(args)+2)
+	replaced := false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--target":
+			result = append(result, args[i], targetArg)
+			if i+1 < len(args) {
+				i++
+			}
+			replaced = true
+		case strings.HasPrefix(args[i], "--target="):
+			result = append(result, "--target="+targetArg)
+			replaced = true
+		default:
+			result = append(result, args[i])
+		}
+	}
+	if !replaced {
+		result = append(result, "--target", targetArg)
+	}
+	return result
+}
+
+// executeInvocations runs a build plan's invocations, respecting their
+// dependency DAG, and reports the first failure. It is shared by run (which
+// loads invocations from a patched build plan) and sysroot (which builds
+// them programmatically via newInvocation).
+func executeInvocations(invocations []Invocation, globalInputs []string, jobs int, force bool, messageFormat string) error {
+	if len(invocations) == 0 {
+		if messageFormat != "human" {
+			emitMessage(buildFinishedMsg{Reason: "build-finished", Success: true})
+		}
+		return nil
+	}
+
 	// Create target directories
 	for _, inv := range invocations {
 		for _, output := range inv.Outputs {
@@ -350,79 +1108,476 @@ func run(buildPlanPath string, replacements map[string]string) {
 		}
 	}
 
-	customBuildDirectives := make(map[string]*CustomBuildDirectives)
+	if jobs < 1 {
+		jobs = 1
+	}
+	log.Printf("Running up to %d invocations in parallel.", jobs)
+
+	fpDir := fingerprintDir()
+	if force {
+		log.Printf("--force given, ignoring cached fingerprints in %s", fpDir)
+	}
+
+	directives := newBuildDirectivesCache()
+
+	byNumber := make(map[int]Invocation, len(invocations))
+	indegree := make(map[int]int, len(invocations))
+	dependents := make(map[int][]int, len(invocations))
+	for _, inv := range invocations {
+		byNumber[inv.Number] = inv
+		indegree[inv.Number] = len(inv.Deps)
+		for _, dep := range inv.Deps {
+			dependents[dep] = append(dependents[dep], inv.Number)
+		}
+	}
+
+	total := len(invocations)
+	ready := make(chan int, total)
+	for num, deg := range indegree {
+		if deg == 0 {
+			ready <- num
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var graphMu sync.Mutex
+	var doneCount int64
+	remaining := int64(total)
+	var firstErrOnce sync.Once
+	var firstErr error
+	retired := make(map[int]bool, total)
+
+	// retire marks every not-yet-dispatched dependent of a failed/retired
+	// invocation as never going to run, transitively, and accounts for it
+	// against `remaining`. A node can only reach `ready` once ALL of its
+	// deps have succeeded, so once one of its ancestors fails, it can never
+	// be dispatched through the normal indegree-reaches-zero path -- this
+	// retires it instead, so `remaining` still reaches 0 and `ready` still
+	// gets closed instead of every worker blocking forever. Must be called
+	// with graphMu held.
+	retire := func(root int) {
+		stack := append([]int(nil), dependents[root]...)
+		for len(stack) > 0 {
+			d := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if retired[d] {
+				continue
+			}
+			retired[d] = true
+			log.Printf("Skipping invocation %d (%s): a dependency failed", d, byNumber[d].PackageName)
+			stack = append(stack, dependents[d]...)
+			if atomic.AddInt64(&remaining, -1) == 0 {
+				close(ready)
+			}
+		}
+	}
+
+	worker := func() {
+		for num := range ready {
+			select {
+			case <-ctx.Done():
+				// Skipped units never release their dependents either, so
+				// retire those too.
+				graphMu.Lock()
+				retire(num)
+				graphMu.Unlock()
+				if atomic.AddInt64(&remaining, -1) == 0 {
+					close(ready)
+				}
+				continue
+			default:
+			}
+
+			inv := byNumber[num]
+			if err := runInvocation(ctx, inv, rustcPath, cargoHome, projectRoot, directives, &doneCount, total, fpDir, globalInputs, force, byNumber, messageFormat); err != nil {
+				firstErrOnce.Do(func() {
+					firstErr = fmt.Errorf("invocation %d (%s): %w", num, inv.PackageName, err)
+					cancel()
+				})
+				graphMu.Lock()
+				retire(num)
+				graphMu.Unlock()
+			} else {
+				graphMu.Lock()
+				for _, dep := range dependents[num] {
+					indegree[dep]--
+					if indegree[dep] == 0 {
+						ready <- dep
+					}
+				}
+				graphMu.Unlock()
+			}
 
-	for i, inv := range invocations {
-		cmdArgs := inv.Args
-		cmdPath := inv.Program
-		if cmdPath == "" {
-			cmdPath = rustcPath
+			if atomic.AddInt64(&remaining, -1) == 0 {
+				close(ready)
+			}
 		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(jobs)
+	for i := 0; i < jobs; i++ {
+		go func() {
+			defer wg.Done()
+			worker()
+		}()
+	}
+	wg.Wait()
+
+	if messageFormat != "human" {
+		emitMessage(buildFinishedMsg{Reason: "build-finished", Success: firstErr == nil})
+	}
 
-		// Apply custom build directives from dependencies
-		if d, ok := customBuildDirectives[inv.PackageName]; ok {
+	return firstErr
+}
+
+// runInvocation executes a single build plan step: it applies any custom
+// build directives inherited from its dependencies, runs the command with
+// its output streamed to the log line-by-line, creates any declared
+// symlinks, and (for build scripts) records its directives for dependents.
+// It returns an error rather than calling log.Fatal so that the caller can
+// cancel in-flight peers and surface only the first failure.
+//
+// Unless force is set, a fingerprint cached under fpDir from a previous run
+// lets an unchanged invocation be skipped entirely.
+//
+// When messageFormat is "json" or "json-render-diagnostics", machine
+// readable records are also written to stdout, matching
+// `cargo --message-format=json`. The human log lines are still written;
+// only a rustc invocation's stderr is turned into compiler-message records
+// instead of being logged.
+func runInvocation(ctx context.Context, inv Invocation, rustcPath, cargoHome, projectRoot string, directives *buildDirectivesCache, doneCount *int64, total int, fpDir string, globalInputs []string, force bool, byNumber map[int]Invocation, messageFormat string) error {
+	jsonMode := messageFormat != "human"
+
+	cmdArgs := inv.Args
+	cmdPath := inv.Program
+	if cmdPath == "" {
+		cmdPath = rustcPath
+	}
+
+	// Apply directives from this invocation's own build script, plus
+	// DEP_<LINKS>_<KEY> metadata forwarded from any dependency that
+	// declares `links` (regardless of package, per Cargo's build-script
+	// protocol). This runs before the freshness check below so that a
+	// changed upstream directive shows up in inv's own hash even when its
+	// own declared args/env are unchanged, mirroring how Cargo chains each
+	// unit's Freshness through its dependencies.
+	for _, dep := range inv.Deps {
+		depInv, ok := byNumber[dep]
+		if !ok || depInv.CompileMode != "run-custom-build" {
+			continue
+		}
+		d, ok := directives.get(dep)
+		if !ok {
+			continue
+		}
+		if depInv.PackageName == inv.PackageName {
 			cmdArgs = append(cmdArgs, d.RustcFlags...)
 			for k, v := range d.EnvVars {
 				inv.Env[k] = v
 			}
 		}
+		if linksName := packageLinksName(depInv); linksName != "" {
+			upperLinks := strings.ToUpper(strings.ReplaceAll(linksName, "-", "_"))
+			for k, v := range d.Metadata {
+				upperKey := strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+				inv.Env[fmt.Sprintf("DEP_%s_%s", upperLinks, upperKey)] = v
+			}
+		}
+	}
+	inv.Args = cmdArgs
 
-		// Ensure OUT_DIR exists
-		if outDir, ok := inv.Env["OUT_DIR"]; ok {
-			if err := os.MkdirAll(outDir, 0755); err != nil {
-				log.Fatalf("Failed to create OUT_DIR %s: %v", outDir, err)
+	fpPath := fingerprintPath(fpDir, inv)
+	if !force {
+		if cached := checkFingerprint(fpPath, inv, globalInputs); cached != nil {
+			if inv.CompileMode == "run-custom-build" && cached.Directives != nil {
+				directives.set(inv.Number, cached.Directives)
+			}
+			if jsonMode {
+				emitFreshMessage(inv, cached)
 			}
+			done := atomic.AddInt64(doneCount, 1)
+			log.Printf("(%d/%d) Fresh, skipping '%s' v%s", done, total, inv.PackageName, inv.PackageVersion)
+			return nil
 		}
+	}
 
-		// Prepare command and environment
-		cmd := exec.Command(cmdPath, cmdArgs...)
-		cmd.Dir = inv.Cwd
-		cmd.Env = os.Environ()
-		// cmd.Env = append(cmd.Env, "CARGO="+filepath.Join(cargoHome, "bin", "cargo"))
-		cmd.Env = append(cmd.Env, fmt.Sprintf("RUSTC=%s", rustcPath))
-		cmd.Env = append(cmd.Env, fmt.Sprintf("CARGO_HOME=%s", cargoHome))
-		cmd.Env = append(cmd.Env, fmt.Sprintf("PROJECT_ROOT=%s", projectRoot))
-		for k, v := range inv.Env {
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
-		}
-		
-		log.Printf("(%d/%d) Running '%s' for package '%s' v%s", i, len(invocations), inv.Program, inv.PackageName, inv.PackageVersion)
-		args_str := strings.Join(cmdArgs, " ")
-		if len(args_str) > 100 {
-			args_str = args_str[:100] + "..."
-		}
-		log.Printf("Invoking: %s %s", cmdPath, args_str)
-		// Run the command
-		var stdout bytes.Buffer
-		cmd.Stdout = &stdout
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-		if err := cmd.Run(); err != nil {
-			log.Printf("Command failed:\n%s %s", cmdPath, strings.Join(cmdArgs, " "))
-			log.Printf("Command stdout:\n%s", stdout.String())
-			log.Printf("Command stderr:\n%s", stderr.String())
-			log.Fatalf("Command failed with exit code %v: %v", cmd.ProcessState.ExitCode(), err)
+	// Ensure OUT_DIR exists
+	if outDir, ok := inv.Env["OUT_DIR"]; ok {
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return fmt.Errorf("failed to create OUT_DIR %s: %w", outDir, err)
+		}
+	}
+
+	// rustc invocations (as opposed to build-script binaries) need
+	// --error-format=json so their diagnostics can be demultiplexed below.
+	isRustcInvocation := cmdPath == rustcPath
+	if jsonMode && isRustcInvocation {
+		cmdArgs = append(cmdArgs, "--error-format=json")
+	}
+
+	// Prepare command and environment
+	cmd := exec.CommandContext(ctx, cmdPath, cmdArgs...)
+	cmd.Dir = inv.Cwd
+	cmd.Env = os.Environ()
+	// cmd.Env = append(cmd.Env, "CARGO="+filepath.Join(cargoHome, "bin", "cargo"))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("RUSTC=%s", rustcPath))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("CARGO_HOME=%s", cargoHome))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("PROJECT_ROOT=%s", projectRoot))
+	for k, v := range inv.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	tag := fmt.Sprintf("[%d:%s]", inv.Number, inv.PackageName)
+	log.Printf("%s Running '%s' for package '%s' v%s", tag, inv.Program, inv.PackageName, inv.PackageVersion)
+	args_str := strings.Join(cmdArgs, " ")
+	if len(args_str) > 100 {
+		args_str = args_str[:100] + "..."
+	}
+	log.Printf("%s Invoking: %s %s", tag, cmdPath, args_str)
+
+	// Stream stdout/stderr line-by-line, tagged by invocation, while still
+	// capturing the raw stdout for build-script directive parsing below. In
+	// JSON mode, a rustc invocation's stderr is demultiplexed into
+	// compiler-message records instead of logged.
+	var stdout bytes.Buffer
+	stdoutLog := newTaggedLogWriter(tag + " stdout:")
+	cmd.Stdout = io.MultiWriter(&stdout, stdoutLog)
+
+	var stderrFlusher interface{ Flush() }
+	if jsonMode && isRustcInvocation {
+		w := newJSONMessageWriter(packageID(inv), messageFormat == "json-render-diagnostics")
+		cmd.Stderr = w
+		stderrFlusher = w
+	} else {
+		w := newTaggedLogWriter(tag + " stderr:")
+		cmd.Stderr = w
+		stderrFlusher = w
+	}
+
+	err := cmd.Run()
+	stdoutLog.Flush()
+	stderrFlusher.Flush()
+	if err != nil {
+		return fmt.Errorf("command failed: %s %s: %w", cmdPath, strings.Join(cmdArgs, " "), err)
+	}
+
+	// Create symlinks
+	for link, target := range inv.Links {
+		if _, err := os.Lstat(link); err == nil {
+			if err := os.Remove(link); err != nil {
+				return fmt.Errorf("failed to remove existing symlink %s: %w", link, err)
+			}
+		}
+		if err := os.Symlink(target, link); err != nil {
+			return fmt.Errorf("failed to create symlink %s -> %s: %w", link, target, err)
+		}
+		log.Printf("%s Created symlink: %s -> %s", tag, link, target)
+	}
+
+	// Capture build script outputs. Downstream units are only released once
+	// this has been stored, since they aren't marked ready until this
+	// invocation returns successfully.
+	var cbDirectives *CustomBuildDirectives
+	if inv.CompileMode == "run-custom-build" {
+		cbDirectives = NewCustomBuildDirectives(stdout.String())
+		directives.set(inv.Number, cbDirectives)
+		if jsonMode {
+			emitMessage(buildScriptExecutedMsg{
+				Reason:      "build-script-executed",
+				PackageID:   packageID(inv),
+				LinkedLibs:  cbDirectives.LinkedLibs,
+				LinkedPaths: cbDirectives.LinkedPaths,
+				Cfgs:        cbDirectives.Cfgs,
+				Env:         cbDirectives.EnvVars,
+				OutDir:      inv.Env["OUT_DIR"],
+			})
 		}
+	} else if jsonMode {
+		emitMessage(compilerArtifactMsg{
+			Reason:    "compiler-artifact",
+			PackageID: packageID(inv),
+			Target:    jsonTarget{Kind: inv.TargetKind, Name: inv.PackageName},
+			Filenames: inv.Outputs,
+			Fresh:     false,
+		})
+	}
 
-		// Create symlinks
-		for link, target := range inv.Links {
-			if _, err := os.Lstat(link); err == nil {
-				if err := os.Remove(link); err != nil {
-					log.Fatalf("Failed to remove existing symlink %s: %v", link, err)
+	// Record a fingerprint so an unchanged invocation can be skipped next
+	// time. Inputs are the dep-info files rustc emits next to its outputs;
+	// the global build-plan inputs are re-read fresh on the next run rather
+	// than cached here.
+	var depFiles []string
+	for _, depInfoPath := range depInfoFilesFor(inv.Outputs) {
+		depFiles = append(depFiles, parseDepInfoFile(depInfoPath)...)
+	}
+	fp := &Fingerprint{
+		InputHash:  hashInvocationInputs(inv, append(append([]string(nil), globalInputs...), depFiles...)),
+		InputFiles: depFiles,
+		Outputs:    inv.Outputs,
+		Directives: cbDirectives,
+	}
+	if err := saveFingerprint(fpPath, fp); err != nil {
+		log.Printf("%s Warning: failed to save fingerprint: %v", tag, err)
+	}
+
+	done := atomic.AddInt64(doneCount, 1)
+	log.Printf("(%d/%d) Finished '%s' v%s", done, total, inv.PackageName, inv.PackageVersion)
+	return nil
+}
+
+// clean wipes the fingerprint cache and, if a build plan is given, the
+// outputs it declares.
+func clean(buildPlanPath string, replacements map[string]string) {
+	dir := fingerprintDir()
+	if err := os.RemoveAll(dir); err != nil {
+		log.Fatalf("Failed to remove fingerprint directory %s: %v", dir, err)
+	}
+	log.Printf("Removed fingerprint directory: %s", dir)
+
+	if buildPlanPath == "" {
+		return
+	}
+
+	invocations, _ := loadInvocations(buildPlanPath, replacements)
+	for _, inv := range invocations {
+		for _, out := range inv.Outputs {
+			if err := os.Remove(out); err != nil {
+				if !os.IsNotExist(err) {
+					log.Printf("Warning: failed to remove output %s: %v", out, err)
 				}
+				continue
 			}
-			if err := os.Symlink(target, link); err != nil {
-				log.Fatalf("Failed to create symlink %s -> %s: %v", link, target, err)
+			log.Printf("Removed output: %s", out)
+		}
+	}
+}
+
+// sysrootCrateDeps gives the build order dependency of the #[no_std] std
+// crates this tool knows how to bootstrap. Crates not listed here are
+// assumed to depend on nothing else in the set.
+var sysrootCrateDeps = map[string][]string{
+	"core":              {},
+	"compiler_builtins": {"core"},
+	"alloc":             {"core"},
+}
+
+// orderSysrootCrates topologically sorts the requested crates by
+// sysrootCrateDeps so each one is built after the dependencies it needs
+// an --extern for.
+func orderSysrootCrates(crates []string) []string {
+	wanted := make(map[string]bool, len(crates))
+	for _, c := range crates {
+		wanted[c] = true
+	}
+
+	var ordered []string
+	visited := make(map[string]bool, len(crates))
+	var visit func(string)
+	visit = func(c string) {
+		if visited[c] {
+			return
+		}
+		visited[c] = true
+		for _, dep := range sysrootCrateDeps[c] {
+			if wanted[dep] {
+				visit(dep)
 			}
-			log.Printf("Created symlink: %s -> %s", link, target)
 		}
+		ordered = append(ordered, c)
+	}
+	for _, c := range crates {
+		visit(c)
+	}
+	return ordered
+}
 
-		// Capture build script outputs
-		if inv.CompileMode == "run-custom-build" {
-			customBuildDirectives[inv.PackageName] = NewCustomBuildDirectives(stdout.String())
+// sysroot builds a minimal custom sysroot for target out of the given std
+// crates (e.g. "core,alloc,compiler_builtins"), compiling each from the
+// source bundled with the host's rustc via `rustc --print sysroot`. It
+// synthesizes its build plan with newInvocation and runs it through the
+// same executeInvocations path as `run`, so the result benefits from the
+// same fingerprinting and logging. The resulting directory,
+// <dir>/<name>/sysroot (dir being --target-dir, else CARGO_TARGET_DIR, else
+// target), is picked up automatically by a later `run --target` for the
+// same target, which appends --sysroot pointing at it; run only looks under
+// CARGO_TARGET_DIR, else target, so a sysroot built under a different
+// --target-dir is not picked up.
+//
+// This does not read a Cargo.toml [package.metadata.cargo-go.sysroot]
+// table: this tool has no TOML parser and the project avoids adding a
+// dependency (and a go.mod) for one. --crates takes the same crate list a
+// manifest table would, just passed on the command line instead.
+func sysroot(target string, cratesList string, targetDirOverride string) {
+	if target == "" {
+		log.Fatalf("Usage: cargo-go sysroot --target TRIPLE --crates core,alloc,compiler_builtins [--target-dir DIR]")
+	}
+	var crates []string
+	for _, c := range strings.Split(cratesList, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			crates = append(crates, c)
 		}
 	}
-	log.Println("Build plan execution complete.")
+	if len(crates) == 0 {
+		log.Fatalf("sysroot requires --crates (e.g. --crates core,alloc,compiler_builtins)")
+	}
+
+	targetArg, targetDirName := resolveTargetSpec(target)
+
+	out, err := exec.Command(rustcPath, "--print", "sysroot").CombinedOutput()
+	if err != nil {
+		log.Fatalf("Failed to query rustc sysroot: %v\n%s", err, string(out))
+	}
+	libSrc := filepath.Join(strings.TrimSpace(string(out)), "lib", "rustlib", "src", "rust", "library")
+
+	base := targetDir()
+	if targetDirOverride != "" {
+		base = targetDirOverride
+	}
+	libDir := filepath.Join(base, targetDirName, "sysroot", "lib", "rustlib", targetDirName, "lib")
+	if err := os.MkdirAll(libDir, 0755); err != nil {
+		log.Fatalf("Failed to create sysroot lib directory %s: %v", libDir, err)
+	}
+
+	var invocations []Invocation
+	byCrate := make(map[string]int)
+	for i, crate := range orderSysrootCrates(crates) {
+		entry := filepath.Join(libSrc, crate, "src", "lib.rs")
+		if _, err := os.Stat(entry); err != nil {
+			log.Fatalf("Could not find source for crate %q at %s (is the rust-src rustup component installed?): %v", crate, entry, err)
+		}
+
+		args := []string{
+			"--edition", "2021",
+			"--crate-name", crate,
+			"--crate-type", "rlib",
+			entry,
+			"--target", targetArg,
+			"-O",
+			"--out-dir", libDir,
+			"-L", libDir,
+		}
+		var deps []int
+		for _, dep := range sysrootCrateDeps[crate] {
+			if depNum, ok := byCrate[dep]; ok {
+				args = append(args, "--extern", fmt.Sprintf("%s=%s", dep, filepath.Join(libDir, "lib"+dep+".rlib")))
+				deps = append(deps, depNum)
+			}
+		}
+
+		inv := newInvocation(i, crate, "build", rustcPath, args, deps, []string{filepath.Join(libDir, "lib"+crate+".rlib")})
+		byCrate[crate] = i
+		invocations = append(invocations, inv)
+	}
+
+	if err := executeInvocations(invocations, nil, 1, false, "human"); err != nil {
+		log.Fatalf("Failed to build sysroot: %v", err)
+	}
+
+	sysrootDir := filepath.Join(base, targetDirName, "sysroot")
+	log.Printf("Sysroot for %s ready at %s", targetArg, sysrootDir)
 }
 
 func main() {
@@ -430,15 +1585,91 @@ func main() {
 	
 	mode := ""
 	buildPlanFile := ""
+	jobs := runtime.NumCPU()
+	force := false
+	messageFormat := "human"
+	genTargetDir := ""
+	genRelease := false
+	genTarget := ""
+	genFeatures := ""
+	var genExtraArgs []string
+	target := ""
+	sysrootTarget := ""
+	sysrootCrates := ""
+	sysrootTargetDir := ""
 
 	args := os.Args[1:]
 	if len(args) == 0 {
-		fmt.Println("Usage: cargo-go [patch|run] <build-plan.json>")
+		fmt.Println("Usage: cargo-go [patch|run|clean|generate|sysroot] <build-plan.json>")
 		os.Exit(1)
 	}
 	mode = args[0]
-	if len(args) > 1 {
-		buildPlanFile = args[1]
+	switch mode {
+	case "generate":
+		genFlags := flag.NewFlagSet("generate", flag.ExitOnError)
+		targetDirFlag := genFlags.String("target-dir", "", "cargo --target-dir to use")
+		releaseFlag := genFlags.Bool("release", false, "build in release mode")
+		targetFlag := genFlags.String("target", "", "target triple (or path to a custom target JSON) to build for")
+		featuresFlag := genFlags.String("features", "", "comma-separated list of features to enable")
+		genFlags.Parse(args[1:])
+		rest := genFlags.Args()
+		if len(rest) < 1 {
+			log.Fatalf("Usage: cargo-go generate [--target-dir DIR] [--release] [--target TRIPLE] [--features LIST] <output.json> [-- <extra cargo args>]")
+		}
+		buildPlanFile = rest[0]
+		if len(rest) > 1 {
+			if rest[1] == "--" {
+				genExtraArgs = rest[2:]
+			} else {
+				genExtraArgs = rest[1:]
+			}
+		}
+		genTargetDir = *targetDirFlag
+		genRelease = *releaseFlag
+		genTarget = *targetFlag
+		genFeatures = *featuresFlag
+	case "run":
+		runFlags := flag.NewFlagSet("run", flag.ExitOnError)
+		jobsFlag := runFlags.Int("j", runtime.NumCPU(), "number of invocations to run concurrently")
+		forceFlag := runFlags.Bool("force", false, "ignore cached fingerprints and rebuild everything")
+		messageFormatFlag := runFlags.String("message-format", "human", "output format: human, json, or json-render-diagnostics")
+		targetFlag := runFlags.String("target", "", "target triple (or path to a custom target JSON) to retarget every invocation to")
+		runFlags.Parse(args[1:])
+		if runFlags.NArg() < 1 {
+			log.Fatalf("Usage: cargo-go run [-j N] [--force] [--message-format=FORMAT] [--target TRIPLE] <build-plan.json>")
+		}
+		switch *messageFormatFlag {
+		case "human", "json", "json-render-diagnostics":
+		default:
+			log.Fatalf("Unknown --message-format: %s", *messageFormatFlag)
+		}
+		buildPlanFile = runFlags.Arg(0)
+		jobs = *jobsFlag
+		force = *forceFlag
+		messageFormat = *messageFormatFlag
+		target = *targetFlag
+	case "patch":
+		patchFlags := flag.NewFlagSet("patch", flag.ExitOnError)
+		targetFlag := patchFlags.String("target", "", "target triple (or path to a custom target JSON) the plan was generated for")
+		patchFlags.Parse(args[1:])
+		if patchFlags.NArg() < 1 {
+			log.Fatalf("Usage: cargo-go patch [--target TRIPLE] <build-plan.json>")
+		}
+		buildPlanFile = patchFlags.Arg(0)
+		target = *targetFlag
+	case "sysroot":
+		sysrootFlags := flag.NewFlagSet("sysroot", flag.ExitOnError)
+		sysrootTargetFlag := sysrootFlags.String("target", "", "target triple (or path to a custom target JSON) to build the sysroot for")
+		sysrootCratesFlag := sysrootFlags.String("crates", "", "comma-separated std crates to build (e.g. core,alloc,compiler_builtins)")
+		sysrootTargetDirFlag := sysrootFlags.String("target-dir", "", "cargo --target-dir equivalent to build the sysroot under")
+		sysrootFlags.Parse(args[1:])
+		sysrootTarget = *sysrootTargetFlag
+		sysrootCrates = *sysrootCratesFlag
+		sysrootTargetDir = *sysrootTargetDirFlag
+	default:
+		if len(args) > 1 {
+			buildPlanFile = args[1]
+		}
 	}
 
 	var err error
@@ -473,12 +1704,23 @@ func main() {
 		"{{CARGO_HOME}}":   cargoHome,
 		"{{RUSTC}}":        rustcPath,
 	}
+	if target != "" {
+		targetArg, targetDirName := resolveTargetSpec(target)
+		replacements["{{TARGET}}"] = targetArg
+		replacements["{{SYSROOT}}"] = filepath.Join(targetDir(), targetDirName, "sysroot")
+	}
 
 	switch mode {
 	case "patch":
 		patch(buildPlanFile, replacements)
 	case "run":
-		run(buildPlanFile, replacements)
+		run(buildPlanFile, replacements, jobs, force, messageFormat, target)
+	case "clean":
+		clean(buildPlanFile, replacements)
+	case "generate":
+		generate(buildPlanFile, genTargetDir, genRelease, genTarget, genFeatures, genExtraArgs, replacements)
+	case "sysroot":
+		sysroot(sysrootTarget, sysrootCrates, sysrootTargetDir)
 	default:
 		log.Fatalf("Unknown mode: %s", mode)
 	}